@@ -0,0 +1,163 @@
+// Copyright©2021,2022 Eric Grosse n2vi.com/0BSD
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var buildLsrOnce sync.Once
+var lsrBinPath string
+var lsrBuildErr error
+
+// buildLsr compiles the lsr binary once per test run and returns its
+// path. The tests below drive that binary as a subprocess rather than
+// calling main() directly, since main() parses os.Args through the
+// package-level flag.CommandLine, which can only be done once per
+// process.
+func buildLsr(t *testing.T) string {
+	t.Helper()
+	buildLsrOnce.Do(func() {
+		dir := t.TempDir()
+		lsrBinPath = filepath.Join(dir, "lsr")
+		cmd := exec.Command("go", "build", "-o", lsrBinPath, ".")
+		cmd.Env = append(os.Environ(), "GO111MODULE=off")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			lsrBuildErr = fmt.Errorf("building lsr: %s\n%s", err, out)
+		}
+	})
+	if lsrBuildErr != nil {
+		t.Fatal(lsrBuildErr)
+	}
+	return lsrBinPath
+}
+
+func runLsr(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(buildLsr(t), args...)
+	cmd.Dir = dir
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("lsr %v: %s\n%s", args, err, out.String())
+	}
+	return out.String()
+}
+
+// dirsInManifest returns the set of directories recorded in .lsr.dirs.
+func dirsInManifest(t *testing.T, dir string) map[string]bool {
+	t.Helper()
+	f, err := os.Open(filepath.Join(dir, ".lsr.dirs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	out := map[string]bool{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var d, b85 string
+		if _, err := fmt.Sscanf(sc.Text(), "%q %s", &d, &b85); err != nil {
+			t.Fatalf("malformed .lsr.dirs line %q: %s", sc.Text(), err)
+		}
+		out[d] = true
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestResumeRebuildsAllDirDigests is a regression test for a bug where a
+// resumed scan only wrote ".lsr.dirs" entries for directories whose
+// files were collected *during that run*. Anything entirely written
+// before the simulated crash point (dirA, dirB here) silently vanished
+// from ".lsr.dirs" and so from every future "lsr diff", even though
+// ".lsr" itself still had their entries.
+func TestResumeRebuildsAllDirDigests(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "dirA", "f1.txt"), "a1")
+	writeFile(t, filepath.Join(dir, "dirA", "f2.txt"), "a2")
+	writeFile(t, filepath.Join(dir, "dirB", "f1.txt"), "b1")
+	for i := 0; i < 20; i++ {
+		writeFile(t, filepath.Join(dir, "many", fmt.Sprintf("f%02d.txt", i)), fmt.Sprintf("m%d", i))
+	}
+
+	runLsr(t, dir, "-mode", "full", "-j", "1")
+	before := dirsInManifest(t, dir)
+	for _, want := range []string{".", "dirA", "dirB", "many"} {
+		if !before[want] {
+			t.Fatalf("fresh scan: expected %q in .lsr.dirs, got %v", want, before)
+		}
+	}
+
+	// Simulate a crash partway through "many": .lsrTEMPORARY only has
+	// dirA, dirB, and part of "many" on disk, with a checkpoint vouching
+	// for exactly that much.
+	lsr, err := os.ReadFile(filepath.Join(dir, ".lsr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimRight(string(lsr), "\n"), "\n")
+	cut := 0
+	for i, line := range lines {
+		if strings.HasPrefix(line, `"many/`) {
+			cut = i
+			break
+		}
+	}
+	if cut == 0 {
+		t.Fatalf("expected some dirA/dirB lines before the first many/ line in %v", lines)
+	}
+	cut += 5 // partway into many/
+	partial := strings.Join(lines[:cut], "\n") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, ".lsrTEMPORARY"), []byte(partial), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var lastName string
+	fmt.Sscanf(lines[cut-1], "%q", &lastName)
+	progress := fmt.Sprintf("%q %d\n", lastName, len(partial))
+	if err := os.WriteFile(filepath.Join(dir, ".lsr.progress"), []byte(progress), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	runLsr(t, dir, "-mode", "full", "-j", "1")
+	after := dirsInManifest(t, dir)
+	for _, want := range []string{".", "dirA", "dirB", "many"} {
+		if !after[want] {
+			t.Errorf("resumed scan: expected %q in .lsr.dirs, got %v", want, after)
+		}
+	}
+
+	var beforeKeys, afterKeys []string
+	for d := range before {
+		beforeKeys = append(beforeKeys, d)
+	}
+	for d := range after {
+		afterKeys = append(afterKeys, d)
+	}
+	sort.Strings(beforeKeys)
+	sort.Strings(afterKeys)
+	if strings.Join(beforeKeys, ",") != strings.Join(afterKeys, ",") {
+		t.Errorf(".lsr.dirs directory set changed across resume: before %v, after %v", beforeKeys, afterKeys)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright©2021,2022 Eric Grosse n2vi.com/0BSD
+
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// statUID and statGID return info's owning uid and gid. They only work
+// when info came from a local stat (os.DirFS), since a remote backend's
+// FileInfo.Sys won't be a *syscall.Stat_t.
+func statUID(info fs.FileInfo) uint32 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Uid
+	}
+	return 0
+}
+
+func statGID(info fs.FileInfo) uint32 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Gid
+	}
+	return 0
+}
+
+// statDev and statIno return info's device and inode numbers, the same
+// way statUID and statGID return its owning uid and gid. Dev's width
+// varies across Unix flavors (e.g. int32 on Darwin, uint64 on Linux),
+// so it's widened to uint64 here for a single portable entry field.
+func statDev(info fs.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev)
+	}
+	return 0
+}
+
+func statIno(info fs.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}